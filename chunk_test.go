@@ -0,0 +1,112 @@
+package main
+
+import (
+	"bytes"
+	"errors"
+	"io"
+	"math/rand"
+	"testing"
+)
+
+// collectChunks runs chunkFile over data and returns the chunks it emitted,
+// verifying along the way that offsets line up back-to-back. Chunk sizes
+// are not checked here.
+func collectChunks(t *testing.T, r io.Reader) ([][]byte, error) {
+	t.Helper()
+	var chunks [][]byte
+	var wantOffset int64
+	err := chunkFile(r, func(offset int64, data []byte) error {
+		if offset != wantOffset {
+			t.Fatalf("chunk offset = %d, want %d", offset, wantOffset)
+		}
+		chunks = append(chunks, append([]byte(nil), data...))
+		wantOffset += int64(len(data))
+		return nil
+	})
+	return chunks, err
+}
+
+func TestChunkFileEmpty(t *testing.T) {
+	chunks, err := collectChunks(t, bytes.NewReader(nil))
+	if err != nil {
+		t.Fatalf("chunkFile returned error: %v", err)
+	}
+	if len(chunks) != 0 {
+		t.Fatalf("got %d chunks for empty input, want 0", len(chunks))
+	}
+}
+
+func TestChunkFileSmallerThanMinChunk(t *testing.T) {
+	data := bytes.Repeat([]byte("x"), cdcMinChunk/2)
+	chunks, err := collectChunks(t, bytes.NewReader(data))
+	if err != nil {
+		t.Fatalf("chunkFile returned error: %v", err)
+	}
+	if len(chunks) != 1 {
+		t.Fatalf("got %d chunks, want 1 (content never reaches cdcMinChunk)", len(chunks))
+	}
+	if !bytes.Equal(chunks[0], data) {
+		t.Fatalf("chunk content doesn't match input (len %d vs %d)", len(chunks[0]), len(data))
+	}
+}
+
+func TestChunkFileExactMultipleOfMaxChunk(t *testing.T) {
+	// Random content, so the rolling hash finds natural boundaries well
+	// before cdcMaxChunk; every chunk must still stay within the size
+	// bounds and the chunks must reassemble into the input.
+	data := make([]byte, 3*cdcMaxChunk)
+	rand.New(rand.NewSource(1)).Read(data)
+
+	chunks, err := collectChunks(t, bytes.NewReader(data))
+	if err != nil {
+		t.Fatalf("chunkFile returned error: %v", err)
+	}
+	if len(chunks) == 0 {
+		t.Fatal("got 0 chunks for non-empty input")
+	}
+
+	var reassembled []byte
+	for i, c := range chunks {
+		if len(c) > cdcMaxChunk {
+			t.Fatalf("chunk %d has length %d, exceeds cdcMaxChunk %d", i, len(c), cdcMaxChunk)
+		}
+		if i < len(chunks)-1 && len(c) < cdcMinChunk {
+			t.Fatalf("non-final chunk %d has length %d, below cdcMinChunk %d", i, len(c), cdcMinChunk)
+		}
+		reassembled = append(reassembled, c...)
+	}
+	if !bytes.Equal(reassembled, data) {
+		t.Fatal("reassembled chunks don't match the original input")
+	}
+}
+
+type errAfterReader struct {
+	data []byte
+	err  error
+}
+
+func (r *errAfterReader) Read(p []byte) (int, error) {
+	if len(r.data) == 0 {
+		return 0, r.err
+	}
+	n := copy(p, r.data)
+	r.data = r.data[n:]
+	return n, nil
+}
+
+func TestChunkFileReadErrorDropsTrailingPartialChunk(t *testing.T) {
+	wantErr := errors.New("boom")
+	r := &errAfterReader{data: bytes.Repeat([]byte("y"), cdcMinChunk/4), err: wantErr}
+
+	var onChunkCalls int
+	err := chunkFile(r, func(offset int64, data []byte) error {
+		onChunkCalls++
+		return nil
+	})
+	if !errors.Is(err, wantErr) {
+		t.Fatalf("chunkFile error = %v, want %v", err, wantErr)
+	}
+	if onChunkCalls != 0 {
+		t.Fatalf("onChunk called %d times, want 0 (partial chunk must not be emitted on a real read error)", onChunkCalls)
+	}
+}
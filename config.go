@@ -0,0 +1,43 @@
+package main
+
+import (
+	"encoding/json"
+	"os"
+)
+
+// Repo is a named source root that Run indexes and copies from. Repos let
+// one invocation merge several independent source trees into the same set
+// of sinks; each repo gets its own subdirectory under every sink so two
+// repos that happen to share a relative path don't collide.
+type Repo struct {
+	Name string `json:"name"`
+	Path string `json:"path"`
+}
+
+// Sink is a named destination root that Run copies to. Sinks let one
+// invocation fan a single set of repos out to several destinations (a local
+// mirror, an external drive, a network share) from a single read of each
+// source file.
+type Sink struct {
+	Name string `json:"name"`
+	Path string `json:"path"`
+}
+
+// config is the on-disk shape of the --config file, which replaces the
+// hardcoded source/destination paths main used to construct directly.
+type config struct {
+	Repos []Repo `json:"repos"`
+	Sinks []Sink `json:"sinks"`
+}
+
+func loadConfig(path string) (*config, error) {
+	data, err := os.ReadFile(path)
+	if err != nil {
+		return nil, err
+	}
+	var cfg config
+	if err := json.Unmarshal(data, &cfg); err != nil {
+		return nil, err
+	}
+	return &cfg, nil
+}
@@ -0,0 +1,20 @@
+//go:build linux
+
+package diskcache
+
+import (
+	"os"
+	"syscall"
+	"time"
+)
+
+// atime extracts the last-access time from a file's platform-specific stat
+// info, used by the LRU evictor to rank cache entries without maintaining a
+// separate access-time index.
+func atime(fi os.FileInfo) time.Time {
+	st, ok := fi.Sys().(*syscall.Stat_t)
+	if !ok {
+		return fi.ModTime()
+	}
+	return time.Unix(st.Atim.Sec, st.Atim.Nsec)
+}
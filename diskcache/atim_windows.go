@@ -0,0 +1,20 @@
+//go:build windows
+
+package diskcache
+
+import (
+	"os"
+	"syscall"
+	"time"
+)
+
+// atime extracts the last-access time from a file's platform-specific stat
+// info, used by the LRU evictor to rank cache entries without maintaining a
+// separate access-time index.
+func atime(fi os.FileInfo) time.Time {
+	d, ok := fi.Sys().(*syscall.Win32FileAttributeData)
+	if !ok {
+		return fi.ModTime()
+	}
+	return time.Unix(0, d.LastAccessTime.Nanoseconds())
+}
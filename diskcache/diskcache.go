@@ -0,0 +1,260 @@
+// Package diskcache implements a content-addressable local disk cache keyed
+// by (sha256, size). FastCopySystem consults it before copying any file: on
+// a hit the destination is produced by a hard link or local copy instead of
+// re-reading the original source, which turns repeated backup runs over
+// overlapping directory trees into near-instant operations.
+package diskcache
+
+import (
+	"fmt"
+	"io"
+	"os"
+	"path/filepath"
+	"sort"
+	"strings"
+	"sync"
+	"time"
+)
+
+// Cache is a content-addressable store rooted at Dir. Entries live at
+// <Dir>/<hh>/<hash>, sharded by the first two hex characters of the hash so
+// no single directory holds the whole cache.
+type Cache struct {
+	Dir       string
+	MaxBytes  int64
+	HighWater int64 // eviction starts once usage crosses this
+	LowWater  int64 // eviction stops once usage falls back to this
+
+	mu    sync.Mutex
+	total int64
+
+	// commitMu serializes Putter.Commit's stat-dest/rename/addBytes
+	// sequence. Without it, concurrent Putters racing to commit identical
+	// content (exactly the case this cache exists for — overlapping backup
+	// runs landing on the same hash) could all observe the miss before any
+	// rename lands and all call addBytes, inflating total by a multiple of
+	// the real on-disk size.
+	commitMu sync.Mutex
+
+	evictCh chan struct{}
+}
+
+// New creates a Cache rooted at dir with the given capacity. HighWater and
+// LowWater default to 95% and 80% of maxBytes; the background evictor is
+// started immediately.
+func New(dir string, maxBytes int64) *Cache {
+	c := &Cache{
+		Dir:       dir,
+		MaxBytes:  maxBytes,
+		HighWater: maxBytes * 95 / 100,
+		LowWater:  maxBytes * 80 / 100,
+		evictCh:   make(chan struct{}, 1),
+	}
+	os.MkdirAll(dir, os.ModePerm)
+	c.total = c.scanSize()
+	go c.evictLoop()
+	c.maybeEvict()
+	return c
+}
+
+func (c *Cache) scanSize() int64 {
+	var total int64
+	filepath.Walk(c.Dir, func(path string, info os.FileInfo, err error) error {
+		if err == nil && !info.IsDir() && !strings.HasPrefix(filepath.Base(path), "putting-") {
+			total += info.Size()
+		}
+		return nil
+	})
+	return total
+}
+
+func (c *Cache) entryPath(hash string) string {
+	shard := hash
+	if len(shard) > 2 {
+		shard = shard[:2]
+	}
+	return filepath.Join(c.Dir, shard, hash)
+}
+
+// Has reports whether (hash, size) is already cached.
+func (c *Cache) Has(hash string, size int64) bool {
+	fi, err := os.Stat(c.entryPath(hash))
+	return err == nil && fi.Size() == size
+}
+
+// Open returns a read handle on the cached entry for (hash, size), bumping
+// its access time so the LRU evictor sees it as recently used.
+func (c *Cache) Open(hash string, size int64) (*os.File, error) {
+	path := c.entryPath(hash)
+	fi, err := os.Stat(path)
+	if err != nil {
+		return nil, err
+	}
+	if fi.Size() != size {
+		return nil, fmt.Errorf("diskcache: size mismatch for %s", hash)
+	}
+	f, err := os.Open(path)
+	if err == nil {
+		c.touch(path)
+	}
+	return f, err
+}
+
+// Produce materializes (hash, size) at dest, preferring a hard link and
+// falling back to a plain copy when linking fails, e.g. because dest is on a
+// different filesystem. A hard link shares its inode with the cached blob —
+// it is not copy-on-write — so callers must never reopen dest with
+// os.Create (or otherwise truncate it) without first removing it; doing so
+// would corrupt the cache entry for every other path still referencing it.
+func (c *Cache) Produce(hash string, size int64, dest string) error {
+	src := c.entryPath(hash)
+	if fi, err := os.Stat(src); err != nil || fi.Size() != size {
+		return fmt.Errorf("diskcache: miss for %s", hash)
+	}
+
+	os.Remove(dest)
+	if err := os.Link(src, dest); err == nil {
+		c.touch(src)
+		return nil
+	}
+
+	in, err := os.Open(src)
+	if err != nil {
+		return err
+	}
+	defer in.Close()
+
+	out, err := os.Create(dest)
+	if err != nil {
+		return err
+	}
+	defer out.Close()
+
+	if _, err := io.Copy(out, in); err != nil {
+		return err
+	}
+	c.touch(src)
+	return nil
+}
+
+func (c *Cache) touch(path string) {
+	now := time.Now()
+	os.Chtimes(path, now, now)
+}
+
+// Putter stages a new cache entry in a temp file under Dir. Callers write to
+// it via Write and then call Commit with the digest of the staged content.
+// Putter doesn't compute that digest itself: callers already compute one for
+// their own purposes (an integrity record, a manifest key), and handing that
+// same digest to Commit avoids hashing the staged bytes a second time.
+type Putter struct {
+	c    *Cache
+	tmp  *os.File
+	path string
+}
+
+func (c *Cache) NewPutter() (*Putter, error) {
+	tmp, err := os.CreateTemp(c.Dir, "putting-*")
+	if err != nil {
+		return nil, err
+	}
+	return &Putter{c: c, tmp: tmp, path: tmp.Name()}, nil
+}
+
+func (p *Putter) Write(b []byte) (int, error) {
+	return p.tmp.Write(b)
+}
+
+// Commit finalizes the entry under the given digest: it moves the staged
+// bytes to their content-addressed path and registers the size against the
+// cache budget. The stat/rename/addBytes sequence runs under c.commitMu so
+// concurrent Putters committing the same hash can't both observe the miss
+// and double-count the size.
+func (p *Putter) Commit(hash string, size int64) (string, error) {
+	p.tmp.Close()
+
+	dest := p.c.entryPath(hash)
+	os.MkdirAll(filepath.Dir(dest), os.ModePerm)
+
+	p.c.commitMu.Lock()
+	defer p.c.commitMu.Unlock()
+
+	if fi, err := os.Stat(dest); err == nil && fi.Size() == size {
+		os.Remove(p.path) // another copy already produced the same content
+		return hash, nil
+	}
+	if err := os.Rename(p.path, dest); err != nil {
+		os.Remove(p.path)
+		return "", err
+	}
+	p.c.addBytes(size)
+	return hash, nil
+}
+
+// Abort discards a staged entry, e.g. because the copy that was feeding it
+// failed.
+func (p *Putter) Abort() {
+	p.tmp.Close()
+	os.Remove(p.path)
+}
+
+func (c *Cache) addBytes(n int64) {
+	c.mu.Lock()
+	c.total += n
+	c.mu.Unlock()
+	c.maybeEvict()
+}
+
+func (c *Cache) maybeEvict() {
+	c.mu.Lock()
+	over := c.total > c.HighWater
+	c.mu.Unlock()
+	if over {
+		select {
+		case c.evictCh <- struct{}{}:
+		default:
+		}
+	}
+}
+
+func (c *Cache) evictLoop() {
+	for range c.evictCh {
+		c.evictUntilLowWater()
+	}
+}
+
+type cacheEntry struct {
+	path  string
+	size  int64
+	atime time.Time
+}
+
+// evictUntilLowWater removes the oldest-atime entries until usage is back
+// at or below LowWater.
+func (c *Cache) evictUntilLowWater() {
+	var entries []cacheEntry
+	filepath.Walk(c.Dir, func(path string, info os.FileInfo, err error) error {
+		if err == nil && !info.IsDir() && !strings.HasPrefix(filepath.Base(path), "putting-") {
+			entries = append(entries, cacheEntry{path: path, size: info.Size(), atime: atime(info)})
+		}
+		return nil
+	})
+	sort.Slice(entries, func(i, j int) bool { return entries[i].atime.Before(entries[j].atime) })
+
+	c.mu.Lock()
+	total := c.total
+	c.mu.Unlock()
+
+	for _, e := range entries {
+		if total <= c.LowWater {
+			break
+		}
+		if err := os.Remove(e.path); err != nil {
+			continue
+		}
+		total -= e.size
+		c.mu.Lock()
+		c.total -= e.size
+		c.mu.Unlock()
+	}
+}
@@ -2,8 +2,13 @@ package main
 
 import (
 	"archive/tar"
+	"archive/zip"
+	"bufio"
+	"crypto/sha256"
 	"database/sql"
+	"flag"
 	"fmt"
+	"hash"
 	"io"
 	"log"
 	"os"
@@ -11,216 +16,1360 @@ import (
 	"sync"
 	"time"
 
+	"github.com/klauspost/compress/zstd"
+	"github.com/klauspost/pgzip"
 	_ "github.com/mattn/go-sqlite3"
+	"github.com/tianqo/Fast-File-Copy-System/diskcache"
 )
 
 const (
 	LargeFileThreshold = 100 * 1024 * 1024 // 100MB
 	BufferSize         = 1 * 1024 * 1024   // 1MB
 	ConcurrentThreads  = 4
+
+	DefaultWorkers  = ConcurrentThreads * 4
+	maxChunkBackoff = 5 * time.Second
+
+	// maxChunkAttempts caps how many times a single chunk is attempted before
+	// requeueChunk gives up on it. Without a cap, a permanent error (disk
+	// full, permission denied, a read-only destination) retries forever and
+	// chunkWG.Wait() in CopyLargeFile never returns.
+	maxChunkAttempts = 8
+
+	// Content-defined chunk boundaries for CopyLargeFile. The rolling hash
+	// only starts looking for a cut once a chunk reaches cdcMinChunk, and
+	// force-cuts at cdcMaxChunk so a long run of boundary-free bytes can't
+	// grow without limit. cdcMask is sized so the expected distance from
+	// cdcMinChunk to the next cut is cdcTargetChunk-cdcMinChunk, which
+	// makes the average chunk size land near cdcTargetChunk.
+	cdcMinChunk    = 512 * 1024
+	cdcTargetChunk = 1024 * 1024
+	cdcMaxChunk    = 8 * 1024 * 1024
+	cdcWindowSize  = 48
+	cdcMask        = uint64(cdcTargetChunk-cdcMinChunk) - 1
 )
 
 type FastCopySystem struct {
-	Src         string
-	Dest        string
-	IndexDB     *sql.DB
-	WaitGroup   sync.WaitGroup
+	// Repos are the source roots indexed and copied from. Sinks are the
+	// destination roots copied to. Every repo is mirrored under its own
+	// name as a subdirectory of every sink, so a merge of several repos
+	// into one sink or a fan-out of one repo to several sinks are both just
+	// the general (repo, path, sink) case.
+	Repos []Repo
+	Sinks []Sink
+
+	IndexDB      *sql.DB
+	WaitGroup    sync.WaitGroup
 	ProgressChan chan int
+
+	// Workers is the number of goroutines storing content-defined chunks of
+	// a single large file concurrently. Zero means DefaultWorkers.
+	Workers int
+	// RetryChan reports a 1 for every chunk that failed to store and was
+	// resubmitted, so the progress goroutine can surface retry counts.
+	RetryChan chan int
+
+	// Resume, when true, makes Run pick an interrupted copy back up using
+	// the blobs/manifests/archive_state/sinks journal instead of recopying
+	// everything from scratch.
+	Resume bool
+
+	// Cache, when set, is consulted before copying any file: a hit is
+	// produced locally instead of re-reading the repo, and every copy feeds
+	// the cache a copy of its bytes for future runs.
+	Cache *diskcache.Cache
+
+	// ArchiveFormat selects the Archiver used for small files: "tar" (the
+	// default), "tar.gz", "tar.zst" or "zip".
+	ArchiveFormat string
 }
 
-func NewFastCopySystem(src, dest string) *FastCopySystem {
+func NewFastCopySystem(repos []Repo, sinks []Sink) *FastCopySystem {
 	db, err := sql.Open("sqlite3", "file_index.db")
 	if err != nil {
 		log.Fatal(err)
 	}
 	_, err = db.Exec(`CREATE TABLE IF NOT EXISTS file_index (
-		path TEXT PRIMARY KEY, 
-		size INTEGER, 
-		mtime DATETIME)`)
+		repo TEXT,
+		path TEXT,
+		size INTEGER,
+		mtime DATETIME,
+		file_hash TEXT,
+		PRIMARY KEY (repo, path))`)
+	if err != nil {
+		log.Fatal(err)
+	}
+	_, err = db.Exec(`CREATE TABLE IF NOT EXISTS archive_state (
+		sink TEXT PRIMARY KEY,
+		completed INTEGER DEFAULT 0)`)
+	if err != nil {
+		log.Fatal(err)
+	}
+	_, err = db.Exec(`CREATE TABLE IF NOT EXISTS sinks (
+		repo TEXT,
+		path TEXT,
+		sink TEXT,
+		completed INTEGER DEFAULT 0,
+		src_size INTEGER,
+		src_mtime DATETIME,
+		PRIMARY KEY (repo, path, sink))`)
+	if err != nil {
+		log.Fatal(err)
+	}
+	_, err = db.Exec(`CREATE TABLE IF NOT EXISTS content_cache (
+		repo TEXT,
+		path TEXT,
+		size INTEGER,
+		mtime DATETIME,
+		hash TEXT,
+		PRIMARY KEY (repo, path))`)
+	if err != nil {
+		log.Fatal(err)
+	}
+	// manifests records, per (repo, path, sink), the ordered sequence of
+	// content-defined chunk hashes that reassemble into the destination
+	// file. It's rebuilt in full on every copy (REPLACE INTO, keyed by
+	// seq), so it never goes stale the way a segment-resume journal could.
+	_, err = db.Exec(`CREATE TABLE IF NOT EXISTS manifests (
+		repo TEXT,
+		path TEXT,
+		sink TEXT,
+		seq INTEGER,
+		chunk_hash TEXT,
+		PRIMARY KEY (repo, path, sink, seq))`)
+	if err != nil {
+		log.Fatal(err)
+	}
+	// blobs tracks every unique chunk stored under each sink's blobs/
+	// directory and how many manifest entries still reference it, so Prune
+	// can garbage-collect chunks that no manifest points to anymore.
+	_, err = db.Exec(`CREATE TABLE IF NOT EXISTS blobs (
+		sink TEXT,
+		hash TEXT,
+		size INTEGER,
+		refcount INTEGER DEFAULT 0,
+		PRIMARY KEY (sink, hash))`)
 	if err != nil {
 		log.Fatal(err)
 	}
 	return &FastCopySystem{
-		Src:         src,
-		Dest:        dest,
-		IndexDB:     db,
+		Repos:        repos,
+		Sinks:        sinks,
+		IndexDB:      db,
 		ProgressChan: make(chan int, 100),
+		RetryChan:    make(chan int, 100),
 	}
 }
 
-func (f *FastCopySystem) UpdateIndex() {
-	filepath.Walk(f.Src, func(path string, info os.FileInfo, err error) error {
-		if !info.IsDir() {
-			_, err = f.IndexDB.Exec(
-				"REPLACE INTO file_index VALUES (?, ?, ?)",
-				path, info.Size(), info.ModTime())
-			if err != nil {
-				log.Println("Index update error:", err)
-			}
+// UpdateIndex walks repo and records every file under it keyed by
+// (repo.Name, path-relative-to-repo.Path).
+func (f *FastCopySystem) UpdateIndex(repo Repo) {
+	filepath.Walk(repo.Path, func(path string, info os.FileInfo, err error) error {
+		if err != nil || info.IsDir() {
+			return nil
+		}
+		relPath, err := filepath.Rel(repo.Path, path)
+		if err != nil {
+			return nil
+		}
+		_, err = f.IndexDB.Exec(
+			"REPLACE INTO file_index (repo, path, size, mtime) VALUES (?, ?, ?, ?)",
+			repo.Name, relPath, info.Size(), info.ModTime())
+		if err != nil {
+			log.Println("Index update error:", err)
 		}
 		return nil
 	})
 }
 
-func (f *FastCopySystem) ArchiveSmallFiles() int {
-	var smallFiles []string
+// archiveEntry identifies one small file to pack into the shared archive:
+// which repo it came from and its path relative to that repo's root. The
+// archiver names its entry by joining the two, so extracting into a sink
+// lands each repo under its own subdirectory instead of colliding.
+type archiveEntry struct {
+	repo string
+	path string
+}
+
+func (e archiveEntry) name() string { return filepath.Join(e.repo, e.path) }
+
+// Archiver packs a set of small files into one archive stream and can later
+// unpack that stream back onto disk. Implementations own their container
+// format and any compression; FastCopySystem stays agnostic of both.
+type Archiver interface {
+	// Name identifies the format and is used as the temp archive file's
+	// extension, e.g. "tar.gz".
+	Name() string
+	// Write streams files into w via open, which callers use instead of
+	// os.Open so a diskcache hit can be served without touching the repo.
+	Write(w io.Writer, files []archiveEntry, open func(archiveEntry) (io.ReadCloser, os.FileInfo, error)) error
+	// Read unpacks the archive at archivePath into destDir.
+	Read(archivePath string, destDir string) error
+}
+
+type tarArchiver struct{}
+
+func (tarArchiver) Name() string { return "tar" }
+
+func (tarArchiver) Write(w io.Writer, files []archiveEntry, open func(archiveEntry) (io.ReadCloser, os.FileInfo, error)) error {
+	tw := tar.NewWriter(w)
+	defer tw.Close()
+	for _, entry := range files {
+		r, fi, err := open(entry)
+		if err != nil {
+			continue
+		}
+		if header, err := tar.FileInfoHeader(fi, ""); err == nil {
+			header.Name = entry.name()
+			tw.WriteHeader(header)
+			io.Copy(tw, r)
+		}
+		r.Close()
+	}
+	return nil
+}
+
+func (tarArchiver) Read(archivePath, destDir string) error {
+	archiveFile, err := os.Open(archivePath)
+	if err != nil {
+		return err
+	}
+	defer archiveFile.Close()
+	return extractTar(archiveFile, destDir)
+}
+
+func extractTar(r io.Reader, destDir string) error {
+	tr := tar.NewReader(r)
+	for {
+		header, err := tr.Next()
+		if err == io.EOF {
+			return nil
+		}
+		if err != nil {
+			return err
+		}
+
+		target := filepath.Join(destDir, header.Name)
+		os.MkdirAll(filepath.Dir(target), os.ModePerm)
+
+		// target may be a hard link Cache.Produce left pointing at a cache
+		// blob (see the doc comment on Produce); os.Create would truncate
+		// that blob in place instead of replacing just this path, so remove
+		// whatever's there first.
+		os.Remove(target)
+		file, err := os.Create(target)
+		if err != nil {
+			continue
+		}
+		io.Copy(file, tr)
+		file.Close()
+	}
+}
+
+// tarGzArchiver is tar compressed with pgzip, which parallelizes gzip
+// compression across blocks so a network-bound destination isn't
+// bottlenecked on a single compressor goroutine.
+type tarGzArchiver struct{}
+
+func (tarGzArchiver) Name() string { return "tar.gz" }
+
+func (tarGzArchiver) Write(w io.Writer, files []archiveEntry, open func(archiveEntry) (io.ReadCloser, os.FileInfo, error)) error {
+	gz := pgzip.NewWriter(w)
+	defer gz.Close()
+	return tarArchiver{}.Write(gz, files, open)
+}
+
+func (tarGzArchiver) Read(archivePath, destDir string) error {
+	archiveFile, err := os.Open(archivePath)
+	if err != nil {
+		return err
+	}
+	defer archiveFile.Close()
+
+	gz, err := pgzip.NewReader(archiveFile)
+	if err != nil {
+		return err
+	}
+	defer gz.Close()
+	return extractTar(gz, destDir)
+}
+
+type tarZstArchiver struct{}
+
+func (tarZstArchiver) Name() string { return "tar.zst" }
+
+func (tarZstArchiver) Write(w io.Writer, files []archiveEntry, open func(archiveEntry) (io.ReadCloser, os.FileInfo, error)) error {
+	zw, err := zstd.NewWriter(w)
+	if err != nil {
+		return err
+	}
+	defer zw.Close()
+	return tarArchiver{}.Write(zw, files, open)
+}
+
+func (tarZstArchiver) Read(archivePath, destDir string) error {
+	archiveFile, err := os.Open(archivePath)
+	if err != nil {
+		return err
+	}
+	defer archiveFile.Close()
+
+	zr, err := zstd.NewReader(archiveFile)
+	if err != nil {
+		return err
+	}
+	defer zr.Close()
+	return extractTar(zr, destDir)
+}
+
+type zipArchiver struct{}
+
+func (zipArchiver) Name() string { return "zip" }
+
+func (zipArchiver) Write(w io.Writer, files []archiveEntry, open func(archiveEntry) (io.ReadCloser, os.FileInfo, error)) error {
+	zw := zip.NewWriter(w)
+	defer zw.Close()
+	for _, entry := range files {
+		r, fi, err := open(entry)
+		if err != nil {
+			continue
+		}
+		if header, err := zip.FileInfoHeader(fi); err == nil {
+			header.Name = entry.name()
+			header.Method = zip.Deflate
+			if out, err := zw.CreateHeader(header); err == nil {
+				io.Copy(out, r)
+			}
+		}
+		r.Close()
+	}
+	return nil
+}
+
+func (zipArchiver) Read(archivePath, destDir string) error {
+	zr, err := zip.OpenReader(archivePath)
+	if err != nil {
+		return err
+	}
+	defer zr.Close()
+
+	for _, entry := range zr.File {
+		target := filepath.Join(destDir, entry.Name)
+		os.MkdirAll(filepath.Dir(target), os.ModePerm)
+
+		rc, err := entry.Open()
+		if err != nil {
+			continue
+		}
+		// See the equivalent os.Remove in extractTar: target may be a hard
+		// link to a cache blob, and os.Create would truncate that blob
+		// in place instead of replacing just this path.
+		os.Remove(target)
+		if out, err := os.Create(target); err == nil {
+			io.Copy(out, rc)
+			out.Close()
+		}
+		rc.Close()
+	}
+	return nil
+}
+
+// resolveArchiver maps f.ArchiveFormat to an Archiver, defaulting to plain
+// tar when unset or unrecognized.
+func (f *FastCopySystem) resolveArchiver() Archiver {
+	switch f.ArchiveFormat {
+	case "tar.gz":
+		return tarGzArchiver{}
+	case "tar.zst":
+		return tarZstArchiver{}
+	case "zip":
+		return zipArchiver{}
+	default:
+		return tarArchiver{}
+	}
+}
+
+// archivePath returns where the small-file archive is staged. It isn't
+// rooted under any one sink since the same archive is read once and
+// extracted into every pending sink.
+func (f *FastCopySystem) archivePath(a Archiver) string {
+	return filepath.Join(os.TempDir(), "fastcopy_archive."+a.Name())
+}
+
+// repoPath looks up a repo's source root by name.
+func (f *FastCopySystem) repoPath(name string) string {
+	for _, repo := range f.Repos {
+		if repo.Name == name {
+			return repo.Path
+		}
+	}
+	return ""
+}
+
+// sinkPath looks up a sink's destination root by name.
+func (f *FastCopySystem) sinkPath(name string) string {
+	for _, sink := range f.Sinks {
+		if sink.Name == name {
+			return sink.Path
+		}
+	}
+	return ""
+}
+
+// countingWriter reports every Write to progress, so the archive phase's
+// progress is driven by bytes actually reaching the underlying stream
+// rather than bytes read from source files — for a compressed format that
+// naturally reflects the compression ratio instead of silently stalling.
+type countingWriter struct {
+	w        io.Writer
+	progress chan int
+}
+
+func (cw *countingWriter) Write(p []byte) (int, error) {
+	n, err := cw.w.Write(p)
+	if n > 0 {
+		cw.progress <- n
+	}
+	return n, err
+}
+
+// teeReadCloser feeds every byte read from r into a running hash, and into
+// the diskcache Putter alongside it when caching is enabled, committing both
+// once the archiver is done reading it.
+type teeReadCloser struct {
+	r      io.ReadCloser
+	tee    io.Reader
+	hash   hash.Hash
+	putter *diskcache.Putter
+	f      *FastCopySystem
+	repo   string
+	path   string
+	size   int64
+	mtime  time.Time
+}
+
+func (t *teeReadCloser) Read(p []byte) (int, error) {
+	return t.tee.Read(p)
+}
+
+func (t *teeReadCloser) Close() error {
+	digest := fmt.Sprintf("%x", t.hash.Sum(nil))
+	t.f.recordFileHash(t.repo, t.path, digest)
+	if t.putter != nil {
+		if _, err := t.putter.Commit(digest, t.size); err == nil {
+			t.f.recordContentHash(t.repo, t.path, t.size, t.mtime, digest)
+		}
+	}
+	return t.r.Close()
+}
+
+// archiveOpen opens entry for archiving, preferring a cached copy when one
+// is known, and tees the read through a hash (and the diskcache, when
+// enabled) so future runs can verify this file's integrity and hit the
+// cache for its content even if it wasn't cached yet.
+func (f *FastCopySystem) archiveOpen(entry archiveEntry) (io.ReadCloser, os.FileInfo, error) {
+	src := filepath.Join(f.repoPath(entry.repo), entry.path)
+	fi, err := os.Stat(src)
+	if err != nil {
+		return nil, nil, err
+	}
+	size := fi.Size()
+	mtime := fi.ModTime()
+
+	var r io.ReadCloser
+	if f.Cache != nil {
+		if hash, ok := f.cachedHash(entry.repo, entry.path, size, mtime); ok {
+			if cached, err := f.Cache.Open(hash, size); err == nil {
+				r = cached
+			}
+		}
+	}
+	if r == nil {
+		file, err := os.Open(src)
+		if err != nil {
+			return nil, nil, err
+		}
+		r = file
+	}
+
+	h := sha256.New()
+	writers := []io.Writer{h}
+
+	var putter *diskcache.Putter
+	if f.Cache != nil {
+		if p, err := f.Cache.NewPutter(); err == nil {
+			putter = p
+			writers = append(writers, putter)
+		}
+	}
+
+	return &teeReadCloser{
+		r: r, tee: io.TeeReader(r, io.MultiWriter(writers...)),
+		hash: h, putter: putter, f: f, repo: entry.repo, path: entry.path, size: size, mtime: mtime,
+	}, fi, nil
+}
+
+// ArchiveSmallFiles streams every small file across every repo into one
+// shared archive using f.ArchiveFormat, reporting bytes written to the
+// archive's underlying stream on f.ProgressChan. Building the archive once
+// and extracting it into each pending sink (done by the caller) means a
+// 3-way mirror reads each small source file once, not three times. It
+// returns the archived entries and the total uncompressed size archived.
+func (f *FastCopySystem) ArchiveSmallFiles() ([]archiveEntry, int64) {
+	var smallFiles []archiveEntry
+	var totalBytes int64
 	rows, _ := f.IndexDB.Query(
-		"SELECT path FROM file_index WHERE size < ?", 
+		"SELECT repo, path, size FROM file_index WHERE size < ?",
 		LargeFileThreshold)
 	defer rows.Close()
 
 	for rows.Next() {
-		var path string
-		rows.Scan(&path)
-		smallFiles = append(smallFiles, path)
+		var repo, path string
+		var size int64
+		rows.Scan(&repo, &path, &size)
+		smallFiles = append(smallFiles, archiveEntry{repo: repo, path: path})
+		totalBytes += size
 	}
 
-	tarFile, _ := os.Create(filepath.Join(f.Dest, "_temp_archive.tar"))
-	defer tarFile.Close()
+	archiver := f.resolveArchiver()
+	archiveFile, err := os.Create(f.archivePath(archiver))
+	if err != nil {
+		log.Println("create archive failed:", err)
+		return nil, 0
+	}
+	defer archiveFile.Close()
 
-	tw := tar.NewWriter(tarFile)
-	defer tw.Close()
+	cw := &countingWriter{w: archiveFile, progress: f.ProgressChan}
+	if err := archiver.Write(cw, smallFiles, f.archiveOpen); err != nil {
+		log.Println("archive write error:", err)
+	}
 
-	for _, file := range smallFiles {
-		fi, _ := os.Stat(file)
-		header, _ := tar.FileInfoHeader(fi, "")
-		header.Name = file
-		tw.WriteHeader(header)
+	return smallFiles, totalBytes
+}
 
-		f, _ := os.Open(file)
-		io.Copy(tw, f)
-		f.Close()
+// verifyExtracted re-hashes every just-extracted small file at sink against
+// the digest recorded in file_index while it was archived, so a bad disk or
+// a truncated copy doesn't silently ship corrupt data. It reports whether
+// every file at this sink verified clean; Run only marks the sink's archive
+// done when it did, so a failure causes the whole small-file batch to be
+// re-extracted for that sink on the next --resume run.
+func (f *FastCopySystem) verifyExtracted(files []archiveEntry, sink Sink) bool {
+	ok := true
+	for _, entry := range files {
+		expected, hasHash := f.expectedHash(entry.repo, entry.path)
+		if !hasHash {
+			continue
+		}
+		target := filepath.Join(sink.Path, entry.repo, entry.path)
+		actual, err := hashFile(target)
+		if err != nil || actual != expected {
+			log.Printf("integrity check failed for %s at sink %s", entry.name(), sink.Name)
+			ok = false
+		}
 	}
+	return ok
+}
 
-	return len(smallFiles)
+// isSinkComplete reports whether (repo, path) was already fully copied to
+// sink on a previous run with the same source size and mtime.
+func (f *FastCopySystem) isSinkComplete(repo, path, sink string, size int64, mtime time.Time) bool {
+	var completed int
+	var dbSize int64
+	var dbMtime time.Time
+	row := f.IndexDB.QueryRow(
+		"SELECT completed, src_size, src_mtime FROM sinks WHERE repo = ? AND path = ? AND sink = ?",
+		repo, path, sink)
+	if err := row.Scan(&completed, &dbSize, &dbMtime); err != nil {
+		return false
+	}
+	return completed != 0 && dbSize == size && dbMtime.Equal(mtime)
 }
 
-func (f *FastCopySystem) CopyLargeFile(src, dest string) {
-	file, _ := os.Open(src)
+func (f *FastCopySystem) markSinkComplete(repo, path, sink string, size int64, mtime time.Time) {
+	_, err := f.IndexDB.Exec(
+		`REPLACE INTO sinks (repo, path, sink, completed, src_size, src_mtime)
+		 VALUES (?, ?, ?, 1, ?, ?)`,
+		repo, path, sink, size, mtime)
+	if err != nil {
+		log.Println("sinks record error:", err)
+	}
+}
+
+// isArchiveDone reports whether a previous run already extracted the
+// small-file archive into sink, so Run can skip redoing it on --resume.
+func (f *FastCopySystem) isArchiveDone(sink string) bool {
+	var completed int
+	row := f.IndexDB.QueryRow("SELECT completed FROM archive_state WHERE sink = ?", sink)
+	if err := row.Scan(&completed); err != nil {
+		return false
+	}
+	return completed != 0
+}
+
+func (f *FastCopySystem) markArchiveDone(sink string) {
+	f.IndexDB.Exec("REPLACE INTO archive_state (sink, completed) VALUES (?, 1)", sink)
+}
+
+// cachedHash returns the content hash recorded for (repo, path) the last
+// time it was copied, if its size and mtime still match. This lets
+// Cache.Has be checked without rereading the file just to compute its
+// digest.
+func (f *FastCopySystem) cachedHash(repo, path string, size int64, mtime time.Time) (string, bool) {
+	var dbSize int64
+	var dbMtime time.Time
+	var hash string
+	row := f.IndexDB.QueryRow(
+		"SELECT size, mtime, hash FROM content_cache WHERE repo = ? AND path = ?", repo, path)
+	if err := row.Scan(&dbSize, &dbMtime, &hash); err != nil {
+		return "", false
+	}
+	if dbSize != size || !dbMtime.Equal(mtime) {
+		return "", false
+	}
+	return hash, true
+}
+
+func (f *FastCopySystem) recordContentHash(repo, path string, size int64, mtime time.Time, hash string) {
+	_, err := f.IndexDB.Exec(
+		"REPLACE INTO content_cache (repo, path, size, mtime, hash) VALUES (?, ?, ?, ?, ?)",
+		repo, path, size, mtime, hash)
+	if err != nil {
+		log.Println("content_cache record error:", err)
+	}
+}
+
+// expectedHash returns the digest file_index recorded for (repo, path) the
+// last time it was copied or archived, if any.
+func (f *FastCopySystem) expectedHash(repo, path string) (string, bool) {
+	var h sql.NullString
+	row := f.IndexDB.QueryRow("SELECT file_hash FROM file_index WHERE repo = ? AND path = ?", repo, path)
+	if err := row.Scan(&h); err != nil || !h.Valid {
+		return "", false
+	}
+	return h.String, true
+}
+
+func (f *FastCopySystem) recordFileHash(repo, path, hash string) {
+	_, err := f.IndexDB.Exec(
+		"UPDATE file_index SET file_hash = ? WHERE repo = ? AND path = ?", hash, repo, path)
+	if err != nil {
+		log.Println("file_hash record error:", err)
+	}
+}
+
+// hashFile reads path in one sequential pass and returns its sha256 digest.
+func hashFile(path string) (string, error) {
+	file, err := os.Open(path)
+	if err != nil {
+		return "", err
+	}
 	defer file.Close()
+	h := sha256.New()
+	if _, err := io.Copy(h, file); err != nil {
+		return "", err
+	}
+	return fmt.Sprintf("%x", h.Sum(nil)), nil
+}
 
-	stat, _ := file.Stat()
-	chunkSize := stat.Size() / ConcurrentThreads
+// buzhashTable is a fixed, well-distributed byte->uint64 substitution table
+// used by the rolling hash below. Its exact values don't matter, only that
+// they're fixed across runs so the same bytes always produce the same chunk
+// boundaries.
+var buzhashTable [256]uint64
+
+func init() {
+	seed := uint64(0x9e3779b97f4a7c15)
+	for i := range buzhashTable {
+		seed ^= seed << 13
+		seed ^= seed >> 7
+		seed ^= seed << 17
+		buzhashTable[i] = seed
+	}
+}
+
+func rol64(x uint64, n int) uint64 {
+	return (x << uint(n)) | (x >> uint(64-n))
+}
 
-	destFile, _ := os.Create(dest)
-	defer destFile.Close()
+// buzhash is a cyclic polynomial rolling hash over the last len(window)
+// bytes seen, letting chunkFile test for a boundary without rehashing the
+// whole window on every byte.
+type buzhash struct {
+	h      uint64
+	window []byte
+	pos    int
+	filled bool
+}
 
-	var mutex sync.Mutex
-	for i := 0; i < ConcurrentThreads; i++ {
-		f.WaitGroup.Add(1)
-		go func(threadNum int) {
-			defer f.WaitGroup.Done()
+func newBuzhash(windowSize int) *buzhash {
+	return &buzhash{window: make([]byte, windowSize)}
+}
 
-			start := int64(threadNum) * chunkSize
-			end := start + chunkSize
-			if threadNum == ConcurrentThreads-1 {
-				end = stat.Size()
+func (b *buzhash) roll(c byte) uint64 {
+	old := b.window[b.pos]
+	b.window[b.pos] = c
+	b.pos = (b.pos + 1) % len(b.window)
+	b.h = rol64(b.h, 1) ^ buzhashTable[c]
+	if b.filled {
+		b.h ^= rol64(buzhashTable[old], len(b.window)%64)
+	}
+	if b.pos == 0 {
+		b.filled = true
+	}
+	return b.h
+}
+
+// chunkFile scans r sequentially and calls onChunk once per content-defined
+// chunk, in order, with the chunk's byte offset and data. A boundary is cut
+// once a chunk has reached cdcMinChunk and the rolling hash's low bits are
+// all zero, or once it reaches cdcMaxChunk regardless of the hash. Because
+// the cut point only depends on recently-seen bytes, inserting or deleting
+// bytes near the start of the file reshuffles just the chunks touching that
+// edit instead of every chunk after it, the way the old fixed-offset split
+// would have. A real read error aborts without emitting the trailing
+// partial chunk, so callers never mistake a truncated read for a complete
+// one.
+func chunkFile(r io.Reader, onChunk func(offset int64, data []byte) error) error {
+	br := bufio.NewReaderSize(r, BufferSize)
+	bh := newBuzhash(cdcWindowSize)
+	chunk := make([]byte, 0, cdcTargetChunk)
+	var offset int64
+	var readErr error
+
+	for {
+		b, err := br.ReadByte()
+		if err != nil {
+			if err != io.EOF {
+				readErr = err
 			}
+			break
+		}
+		chunk = append(chunk, b)
+		h := bh.roll(b)
+
+		cut := len(chunk) >= cdcMaxChunk
+		if len(chunk) >= cdcMinChunk && h&cdcMask == 0 {
+			cut = true
+		}
+		if cut {
+			if err := onChunk(offset, chunk); err != nil {
+				return err
+			}
+			offset += int64(len(chunk))
+			chunk = make([]byte, 0, cdcTargetChunk)
+		}
+	}
+
+	if readErr != nil {
+		return readErr
+	}
+	if len(chunk) > 0 {
+		if err := onChunk(offset, chunk); err != nil {
+			return err
+		}
+	}
+	return nil
+}
+
+// chunkJob is one content-defined chunk waiting to be stored and recorded in
+// the manifest of every sink in remaining. remaining starts as every
+// pending sink and shrinks as each one succeeds, so a retry after a
+// partial failure only re-attempts the sinks that actually failed instead
+// of re-storing (and over-counting the refcount of) ones that already
+// succeeded.
+type chunkJob struct {
+	seq       int
+	hash      string
+	data      []byte
+	remaining []Sink
+}
+
+// requeueChunk schedules job to be retried on backlog after an exponential
+// backoff keyed on how many times this chunk has already failed, and
+// reports the retry on RetryChan. Once job has failed maxChunkAttempts
+// times, it gives up and reports false instead of requeuing, so the caller
+// can stop waiting on it rather than retrying a permanent error forever.
+func (f *FastCopySystem) requeueChunk(backlog chan chunkJob, job chunkJob, attempts map[int]int, attemptsMu *sync.Mutex) bool {
+	attemptsMu.Lock()
+	attempts[job.seq]++
+	n := attempts[job.seq]
+	attemptsMu.Unlock()
+
+	if n >= maxChunkAttempts {
+		log.Printf("chunk %d of %s gave up after %d attempts for %d sink(s)\n", job.seq, job.hash, n, len(job.remaining))
+		return false
+	}
+
+	select {
+	case f.RetryChan <- 1:
+	default:
+	}
+
+	delay := (200 * time.Millisecond) << uint(n-1)
+	if delay > maxChunkBackoff {
+		delay = maxChunkBackoff
+	}
+	go func() {
+		time.Sleep(delay)
+		backlog <- job
+	}()
+	return true
+}
 
-			buf := make([]byte, BufferSize)
-			file.Seek(start, 0)
-			destFile.Seek(start, 0)
+// storeBlob writes data under sink's blobs/ directory keyed by hash, unless
+// a blob with that hash and size is already there. Deduping here is what
+// lets a re-copy of a modified large file only transfer the chunks that
+// actually changed. It stages to a uniquely-named temp file before the
+// rename, since two workers processing different (same-hashing) chunks of
+// the same file concurrently would otherwise race on a shared tmp path.
+func (f *FastCopySystem) storeBlob(sink, hash string, data []byte) error {
+	dir := filepath.Join(f.sinkPath(sink), "blobs", hash[:2])
+	path := filepath.Join(dir, hash)
+	if fi, err := os.Stat(path); err == nil && fi.Size() == int64(len(data)) {
+		return nil
+	}
+	if err := os.MkdirAll(dir, os.ModePerm); err != nil {
+		return err
+	}
+	tmp, err := os.CreateTemp(dir, hash+".tmp-*")
+	if err != nil {
+		return err
+	}
+	tmpPath := tmp.Name()
+	_, werr := tmp.Write(data)
+	tmp.Close()
+	if werr != nil {
+		os.Remove(tmpPath)
+		return werr
+	}
+	if err := os.Rename(tmpPath, path); err != nil {
+		os.Remove(tmpPath)
+		return err
+	}
+	return nil
+}
+
+// bumpRefcount records a new reference to (sink, hash), creating its blobs
+// row with refcount 1 if this is the first. Callers must only call this
+// once per manifest slot that newly starts referencing hash — see
+// appendManifest, which is the only caller.
+func (f *FastCopySystem) bumpRefcount(sink, hash string, size int64) error {
+	_, err := f.IndexDB.Exec(
+		`INSERT INTO blobs (sink, hash, size, refcount) VALUES (?, ?, ?, 1)
+		 ON CONFLICT(sink, hash) DO UPDATE SET refcount = refcount + 1`,
+		sink, hash, size)
+	return err
+}
 
-			for pos := start; pos < end; {
-				readSize := min(BufferSize, end-pos)
-				n, _ := file.Read(buf[:readSize])
+// decrementRefcount drops sink's reference count for hash by one, e.g.
+// because a manifest slot that used to reference it now references a
+// different hash, or was deleted outright. It never goes below zero;
+// Prune then collects any blob whose refcount has reached it.
+func (f *FastCopySystem) decrementRefcount(sink, hash string) error {
+	_, err := f.IndexDB.Exec(
+		"UPDATE blobs SET refcount = refcount - 1 WHERE sink = ? AND hash = ? AND refcount > 0",
+		sink, hash)
+	return err
+}
 
-				mutex.Lock()
-				destFile.Write(buf[:n])
-				mutex.Unlock()
+// appendManifest records chunk hash as the seq'th chunk of (repo, path)'s
+// destination at sink. Refcount only moves when this manifest slot's
+// reference actually changes: bumping hash's refcount is skipped if the
+// slot already pointed at it (otherwise a re-run over unchanged content,
+// with no whole-file cache hit, would inflate the refcount every single
+// time instead of just once per actual new reference), and the slot's
+// previous hash, if any and if different, is decremented so Prune can
+// eventually collect it. It's a REPLACE, so rebuilding a manifest from seq
+// 0 on every copy is always safe and never leaves stale trailing entries
+// from a previous, longer version of the file — any of those get
+// overwritten up to the new chunk count, and Materialize only reads up to
+// that count; the leftover tail past the new count is handled separately
+// by the caller, which decrements those slots before deleting them.
+func (f *FastCopySystem) appendManifest(repo, path, sink string, seq int, hash string, size int64) {
+	var existing string
+	row := f.IndexDB.QueryRow(
+		"SELECT chunk_hash FROM manifests WHERE repo = ? AND path = ? AND sink = ? AND seq = ?",
+		repo, path, sink, seq)
+	hadExisting := row.Scan(&existing) == nil
+	alreadyReferenced := hadExisting && existing == hash
 
-				pos += int64(n)
-				f.ProgressChan <- n
+	if !alreadyReferenced {
+		if hadExisting {
+			if err := f.decrementRefcount(sink, existing); err != nil {
+				log.Println("blobs refcount error:", err)
 			}
-		}(i)
+		}
+		if err := f.bumpRefcount(sink, hash, size); err != nil {
+			log.Println("blobs refcount error:", err)
+		}
+	}
+
+	_, err := f.IndexDB.Exec(
+		"REPLACE INTO manifests (repo, path, sink, seq, chunk_hash) VALUES (?, ?, ?, ?, ?)",
+		repo, path, sink, seq, hash)
+	if err != nil {
+		log.Println("manifest append error:", err)
 	}
 }
 
-func (f *FastCopySystem) Run() {
-	start := time.Now()
-	
-	// 更新索引
-	fmt.Println("[*] Updating file index...")
-	f.UpdateIndex()
+// Materialize reassembles the real file for (repo, path) at sink by reading
+// its manifest in chunk order and concatenating each chunk's blob, the way
+// the Archiver's Read reconstitutes small files from the shared archive at
+// the end of Run.
+func (f *FastCopySystem) Materialize(repo, path, sink string) error {
+	dest := filepath.Join(f.sinkPath(sink), repo, path)
+	os.MkdirAll(filepath.Dir(dest), os.ModePerm)
 
-	// 归档小文件
-	fmt.Println("[*] Archiving small files...")
-	archiveCount := f.ArchiveSmallFiles()
+	// dest may still be a hard link Produce left pointing at a cache blob;
+	// os.Create would truncate that blob in place instead of just this
+	// path, so remove whatever's there first (see diskcache.Cache.Produce).
+	os.Remove(dest)
+	out, err := os.Create(dest)
+	if err != nil {
+		return err
+	}
+	defer out.Close()
 
-	// 复制大文件
-	fmt.Println("[*] Copying large files...")
-	rows, _ := f.IndexDB.Query(
-		"SELECT path FROM file_index WHERE size >= ?", 
-		LargeFileThreshold)
+	rows, err := f.IndexDB.Query(
+		"SELECT chunk_hash FROM manifests WHERE repo = ? AND path = ? AND sink = ? ORDER BY seq",
+		repo, path, sink)
+	if err != nil {
+		return err
+	}
 	defer rows.Close()
 
-	var largeFiles []string
+	blobDir := filepath.Join(f.sinkPath(sink), "blobs")
 	for rows.Next() {
-		var path string
-		rows.Scan(&path)
-		largeFiles = append(largeFiles, path)
+		var hash string
+		if err := rows.Scan(&hash); err != nil {
+			return err
+		}
+		blob, err := os.Open(filepath.Join(blobDir, hash[:2], hash))
+		if err != nil {
+			return err
+		}
+		_, err = io.Copy(out, blob)
+		blob.Close()
+		if err != nil {
+			return err
+		}
 	}
+	return nil
+}
+
+// Prune deletes every blob under sink whose refcount has dropped to zero,
+// freeing the space held by chunks no manifest slot references anymore
+// (e.g. because a rewritten large file's chunks changed, or it shrank and
+// dropped trailing chunks — both decrement refcount in appendManifest and
+// CopyLargeFile's stale-tail cleanup respectively). It's a separate,
+// explicit step rather than something Run calls automatically. A file
+// removed from a repo entirely doesn't yet decrement its chunks' refcounts
+// anywhere, since nothing in this tool currently notices that kind of
+// source deletion; that's left for a future cleanup pass over stale
+// file_index entries.
+func (f *FastCopySystem) Prune(sink string) (int, error) {
+	rows, err := f.IndexDB.Query("SELECT hash FROM blobs WHERE sink = ? AND refcount <= 0", sink)
+	if err != nil {
+		return 0, err
+	}
+	var hashes []string
+	for rows.Next() {
+		var hash string
+		if err := rows.Scan(&hash); err != nil {
+			rows.Close()
+			return 0, err
+		}
+		hashes = append(hashes, hash)
+	}
+	rows.Close()
+
+	blobDir := filepath.Join(f.sinkPath(sink), "blobs")
+	var pruned int
+	for _, hash := range hashes {
+		os.Remove(filepath.Join(blobDir, hash[:2], hash))
+		if _, err := f.IndexDB.Exec("DELETE FROM blobs WHERE sink = ? AND hash = ?", sink, hash); err == nil {
+			pruned++
+		}
+	}
+	return pruned, nil
+}
+
+// CopyLargeFile copies repo's path to every sink in sinks by splitting the
+// source into content-defined chunks and pulling them through a pool of
+// workers that store each chunk once per pending sink's blob store and
+// append it to that sink's manifest. A chunk whose store fails at any sink
+// is pushed onto backlog with an exponential-backoff sleep and retried
+// instead of aborting the whole copy. Once every chunk is stored,
+// Materialize reassembles the real destination file at each sink from its
+// manifest. CopyLargeFile returns immediately; completion is observed via
+// f.WaitGroup, same as the rest of the large-file pipeline.
+//
+// Chunking always rescans the source from byte 0 — a rolling hash can't be
+// resumed partway through without storing its entire window state — but
+// re-copying an unchanged or lightly-edited large file still only pays for
+// chunks whose content actually changed: storeBlob skips any chunk whose
+// hash is already present at that sink.
+//
+// When f.Resume is set, sinks this (repo, path) already finished copying to
+// with the same source size and mtime are skipped entirely.
+func (f *FastCopySystem) CopyLargeFile(repo Repo, path string, sinks []Sink) {
+	src := filepath.Join(repo.Path, path)
+	file, err := os.Open(src)
+	if err != nil {
+		log.Println("open source failed:", err)
+		return
+	}
+
+	stat, _ := file.Stat()
+	size := stat.Size()
+	mtime := stat.ModTime()
+
+	var pending []Sink
+	for _, sink := range sinks {
+		if f.Resume && f.isSinkComplete(repo.Name, path, sink.Name, size, mtime) {
+			continue
+		}
+		pending = append(pending, sink)
+	}
+	if len(pending) == 0 {
+		file.Close()
+		fmt.Printf("\n[resume] already complete, skipping: %s\n", src)
+		return
+	}
+
+	destFor := func(sink Sink) string {
+		return filepath.Join(sink.Path, repo.Name, path)
+	}
+
+	if f.Cache != nil {
+		if hash, ok := f.cachedHash(repo.Name, path, size, mtime); ok && f.Cache.Has(hash, size) {
+			producedAll := true
+			for _, sink := range pending {
+				dest := destFor(sink)
+				os.MkdirAll(filepath.Dir(dest), os.ModePerm)
+				if err := f.Cache.Produce(hash, size, dest); err != nil {
+					producedAll = false
+					break
+				}
+			}
+			if producedAll {
+				file.Close()
+				f.ProgressChan <- int(size)
+				if f.Resume {
+					for _, sink := range pending {
+						f.markSinkComplete(repo.Name, path, sink.Name, size, mtime)
+					}
+				}
+				return
+			}
+		}
+	}
+
+	workers := f.Workers
+	if workers <= 0 {
+		workers = DefaultWorkers
+	}
+
+	f.WaitGroup.Add(1)
+	go func() {
+		defer f.WaitGroup.Done()
+		defer file.Close()
+
+		instructions := make(chan chunkJob, workers*2)
+		backlog := make(chan chunkJob, workers*2)
+		done := make(chan struct{})
+		var chunkWG sync.WaitGroup
+		attempts := make(map[int]int)
+		var attemptsMu sync.Mutex
+		failedSinks := make(map[string]bool)
+		var failedSinksMu sync.Mutex
+
+		var pool sync.WaitGroup
+		for i := 0; i < workers; i++ {
+			pool.Add(1)
+			go func() {
+				defer pool.Done()
+				instr := instructions
+				for {
+					var job chunkJob
+					select {
+					case j, ok := <-instr:
+						if !ok {
+							instr = nil
+							continue
+						}
+						job = j
+					case j := <-backlog:
+						job = j
+					case <-done:
+						return
+					}
+
+					var stillRemaining []Sink
+					for _, sink := range job.remaining {
+						if err := f.storeBlob(sink.Name, job.hash, job.data); err != nil {
+							stillRemaining = append(stillRemaining, sink)
+							continue
+						}
+						f.appendManifest(repo.Name, path, sink.Name, job.seq, job.hash, int64(len(job.data)))
+					}
+					if len(stillRemaining) > 0 {
+						job.remaining = stillRemaining
+						if !f.requeueChunk(backlog, job, attempts, &attemptsMu) {
+							failedSinksMu.Lock()
+							for _, sink := range stillRemaining {
+								failedSinks[sink.Name] = true
+							}
+							failedSinksMu.Unlock()
+							chunkWG.Done()
+							continue
+						}
+						continue
+					}
+					f.ProgressChan <- len(job.data)
+					chunkWG.Done()
+				}
+			}()
+		}
+
+		hasher := sha256.New()
+		var seq int
+		chunkErr := chunkFile(file, func(offset int64, data []byte) error {
+			hash := fmt.Sprintf("%x", sha256.Sum256(data))
+			hasher.Write(data)
+			chunkWG.Add(1)
+			instructions <- chunkJob{seq: seq, hash: hash, data: data, remaining: pending}
+			seq++
+			return nil
+		})
+		close(instructions)
+		chunkWG.Wait()
+		close(done)
+		pool.Wait()
+
+		if chunkErr != nil {
+			log.Println("chunking failed, leaving", src, "uncopied for this run:", chunkErr)
+			return
+		}
+
+		digest := fmt.Sprintf("%x", hasher.Sum(nil))
+		f.recordFileHash(repo.Name, path, digest)
+
+		// Drop any manifest tail left over from a longer previous version of
+		// this file, so Materialize doesn't append stale trailing chunks.
+		// Each dropped slot stops referencing its hash, so decrement that
+		// hash's refcount first — otherwise those blobs could never reach
+		// refcount 0 and Prune would never collect them.
+		for _, sink := range pending {
+			rows, err := f.IndexDB.Query(
+				"SELECT chunk_hash FROM manifests WHERE repo = ? AND path = ? AND sink = ? AND seq >= ?",
+				repo.Name, path, sink.Name, seq)
+			if err == nil {
+				for rows.Next() {
+					var hash string
+					if rows.Scan(&hash) == nil {
+						f.decrementRefcount(sink.Name, hash)
+					}
+				}
+				rows.Close()
+			}
+			f.IndexDB.Exec(
+				"DELETE FROM manifests WHERE repo = ? AND path = ? AND sink = ? AND seq >= ?",
+				repo.Name, path, sink.Name, seq)
+		}
+
+		var materialized []Sink
+		for _, sink := range pending {
+			if failedSinks[sink.Name] {
+				log.Printf("giving up on %s for sink %s: one or more chunks never stored after %d attempts\n", src, sink.Name, maxChunkAttempts)
+				continue
+			}
+			if err := f.Materialize(repo.Name, path, sink.Name); err != nil {
+				log.Println("materialize failed:", err)
+				continue
+			}
+			materialized = append(materialized, sink)
+			if f.Resume {
+				f.markSinkComplete(repo.Name, path, sink.Name, size, mtime)
+			}
+		}
+
+		// Feed the whole-file diskcache too (from whichever successfully
+		// materialized sink), so a future copy of identical content to a
+		// brand new sink or repo can skip chunking entirely via the
+		// Cache.Produce fast path above.
+		if f.Cache != nil {
+			for _, sink := range materialized {
+				dest, err := os.Open(destFor(sink))
+				if err != nil {
+					continue
+				}
+				p, err := f.Cache.NewPutter()
+				if err != nil {
+					dest.Close()
+					break
+				}
+				io.Copy(p, dest)
+				dest.Close()
+				if _, err := p.Commit(digest, size); err == nil {
+					f.recordContentHash(repo.Name, path, size, mtime, digest)
+				}
+				break
+			}
+		}
+	}()
+}
+
+func (f *FastCopySystem) Run() {
+	start := time.Now()
+
+	fmt.Println("[*] Updating file index...")
+	for _, repo := range f.Repos {
+		f.UpdateIndex(repo)
+	}
+
+	archiver := f.resolveArchiver()
+	archivePath := f.archivePath(archiver)
+
+	// Pre-sum bytes across both phases so the progress meter can render a
+	// percentage instead of just a running total. Progress is counted once,
+	// not once per sink written, since every sink shares the same read and
+	// the same archive. Large-file progress counts source bytes; archive
+	// progress counts bytes written to the archive stream (see
+	// countingWriter), which for a compressed format differ from the source
+	// sizes summed here.
+	var archiveBytes, largeBytes int64
+	f.IndexDB.QueryRow(
+		"SELECT COALESCE(SUM(size), 0) FROM file_index WHERE size < ?", LargeFileThreshold,
+	).Scan(&archiveBytes)
+	f.IndexDB.QueryRow(
+		"SELECT COALESCE(SUM(size), 0) FROM file_index WHERE size >= ?", LargeFileThreshold,
+	).Scan(&largeBytes)
+	totalBytes := archiveBytes + largeBytes
 
 	// 进度监控
 	go func() {
 		var total int64
-		for n := range f.ProgressChan {
-			total += int64(n)
-			fmt.Printf("\rCopied: %.2f MB", float64(total)/1024/1024)
+		var retries int64
+		for {
+			select {
+			case n, ok := <-f.ProgressChan:
+				if !ok {
+					return
+				}
+				total += int64(n)
+				pct := 0.0
+				if totalBytes > 0 {
+					pct = float64(total) / float64(totalBytes) * 100
+				}
+				fmt.Printf("\rCopied: %.2f MB / %.2f MB (%.1f%%, retries: %d)",
+					float64(total)/1024/1024, float64(totalBytes)/1024/1024, pct, retries)
+			case r, ok := <-f.RetryChan:
+				if !ok {
+					continue
+				}
+				retries += int64(r)
+			}
 		}
 	}()
 
-	for _, path := range largeFiles {
-		relPath, _ := filepath.Rel(f.Src, path)
-		destPath := filepath.Join(f.Dest, relPath)
-		os.MkdirAll(filepath.Dir(destPath), os.ModePerm)
-		f.CopyLargeFile(path, destPath)
+	// 归档小文件
+	var pendingArchiveSinks []Sink
+	for _, sink := range f.Sinks {
+		if f.Resume && f.isArchiveDone(sink.Name) {
+			continue
+		}
+		pendingArchiveSinks = append(pendingArchiveSinks, sink)
+	}
+
+	var archivedFiles []archiveEntry
+	if len(pendingArchiveSinks) == 0 {
+		fmt.Println("[*] Archive already completed for every sink, skipping")
+	} else {
+		fmt.Println("[*] Archiving small files...")
+		archivedFiles, _ = f.ArchiveSmallFiles()
+	}
+
+	// 复制大文件
+	fmt.Println("[*] Copying large files...")
+	var largeFileCount int
+	for _, repo := range f.Repos {
+		rows, _ := f.IndexDB.Query(
+			"SELECT path FROM file_index WHERE repo = ? AND size >= ?",
+			repo.Name, LargeFileThreshold)
+		var paths []string
+		for rows.Next() {
+			var path string
+			rows.Scan(&path)
+			paths = append(paths, path)
+		}
+		rows.Close()
+
+		for _, path := range paths {
+			f.CopyLargeFile(repo, path, f.Sinks)
+			largeFileCount++
+		}
 	}
 
 	f.WaitGroup.Wait()
 	close(f.ProgressChan)
 
 	// 解压归档
-	fmt.Println("\n[*] Extracting small files...")
-	f.ExtractArchive()
+	if len(pendingArchiveSinks) == 0 {
+		fmt.Println("\n[*] Archive already extracted for every sink, skipping")
+	} else {
+		fmt.Println("\n[*] Extracting small files...")
+		for _, sink := range pendingArchiveSinks {
+			if err := archiver.Read(archivePath, sink.Path); err != nil {
+				log.Println("archive extract error:", err)
+				continue
+			}
+			if f.verifyExtracted(archivedFiles, sink) {
+				f.markArchiveDone(sink.Name)
+			} else {
+				log.Printf("archive verification failed for sink %s, will re-extract on next --resume run", sink.Name)
+			}
+		}
+		os.Remove(archivePath)
+	}
 
 	fmt.Printf("[+] Completed in %.2f seconds\n", time.Since(start).Seconds())
-	fmt.Printf("    Archived files: %d\n", archiveCount)
-	fmt.Printf("    Copied large files: %d\n", len(largeFiles))
+	fmt.Printf("    Archived files: %d\n", len(archivedFiles))
+	fmt.Printf("    Copied large files: %d\n", largeFileCount)
 }
 
-func (f *FastCopySystem) ExtractArchive() {
-	tarFile, _ := os.Open(filepath.Join(f.Dest, "_temp_archive.tar"))
-	defer tarFile.Close()
-	defer os.Remove(filepath.Join(f.Dest, "_temp_archive.tar"))
-
-	tr := tar.NewReader(tarFile)
-	for {
-		header, err := tr.Next()
-		if err == io.EOF {
-			break
-		}
+func main() {
+	configPath := flag.String("config", "fastcopy.json", "path to a JSON config file listing repos and sinks")
+	resume := flag.Bool("resume", false, "resume a previously interrupted copy using the copy journal")
+	cacheDir := flag.String("cache-dir", "", "content-addressable cache directory (disabled if empty)")
+	cacheMaxMB := flag.Int64("cache-max-mb", 10*1024, "max cache size in MB once --cache-dir is set")
+	archiveFormat := flag.String("archive-format", "tar", "small-file archive format: tar, tar.gz, tar.zst or zip")
+	prune := flag.Bool("prune", false, "garbage-collect zero-refcount blobs in every configured sink, then exit")
+	flag.Parse()
 
-		target := filepath.Join(f.Dest, header.Name)
-		os.MkdirAll(filepath.Dir(target), os.ModePerm)
+	cfg, err := loadConfig(*configPath)
+	if err != nil {
+		log.Fatal("load config failed:", err)
+	}
 
-		file, _ := os.Create(target)
-		io.Copy(file, tr)
-		file.Close()
+	copier := NewFastCopySystem(cfg.Repos, cfg.Sinks)
+	copier.Resume = *resume
+	copier.ArchiveFormat = *archiveFormat
+	if *cacheDir != "" {
+		copier.Cache = diskcache.New(*cacheDir, *cacheMaxMB*1024*1024)
 	}
-}
 
-func min(a, b int64) int64 {
-	if a < b {
-		return a
+	if *prune {
+		for _, sink := range copier.Sinks {
+			n, err := copier.Prune(sink.Name)
+			if err != nil {
+				log.Println("prune failed for sink", sink.Name, ":", err)
+				continue
+			}
+			fmt.Printf("[*] pruned %d blobs from sink %s\n", n, sink.Name)
+		}
+		return
 	}
-	return b
-}
 
-func main() {
-	copier := NewFastCopySystem(
-		"D:\\Minecraft",
-		"E:\\Backup",
-	)
 	copier.Run()
-}
\ No newline at end of file
+}